@@ -0,0 +1,89 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "time"
+
+// BrokerConfiguration represents configuration for the Kafka broker connection
+// used by KafkaConsumer.
+type BrokerConfiguration struct {
+	Address string
+	Topic   string
+	Group   string
+	Timeout time.Duration
+
+	// KafkaParallelMessages sets the number of worker goroutines draining
+	// the Upstream channel created by CreateConsumerChannels. Values less
+	// than 1 are treated as 1 (no parallelism).
+	KafkaParallelMessages int
+
+	// KafkaVersion is the Kafka protocol version to negotiate with the
+	// broker, parsed via sarama.ParseKafkaVersion. Empty defaults to
+	// sarama.V0_10_2_0.
+	KafkaVersion string
+
+	// Assignor selects the partition assignment strategy used during
+	// consumer-group rebalances: "range", "roundrobin" or "sticky". Empty
+	// defaults to "range".
+	Assignor string
+
+	// Oldest, when true, makes the consumer start from the oldest available
+	// offset (OffsetOldest) for partitions without a committed offset,
+	// instead of the newest (OffsetNewest).
+	Oldest bool
+
+	// OffsetsInitTimeout bounds how long Setup waits, via
+	// WaitForOffsetsInitialized, for every assigned partition's
+	// consumer-group offset to become available before aborting the
+	// session. Zero disables the wait.
+	OffsetsInitTimeout time.Duration
+
+	// Security configures SASL/TLS for the broker connection. A nil value
+	// leaves the connection plaintext.
+	Security *SecurityConfiguration
+
+	// Monitoring configures the health/metrics HTTP endpoint started by
+	// KafkaConsumer.Serve. A zero value (empty Address) disables the HTTP
+	// endpoint; the SIGUSR1 pause/resume handler is started regardless.
+	Monitoring MonitoringConfiguration
+}
+
+// SecurityConfiguration configures SASL authentication and/or TLS for
+// connections to the Kafka broker, as typically required by managed Kafka
+// offerings (MSK, Confluent Cloud, Red Hat OpenShift Streams).
+type SecurityConfiguration struct {
+	// SASLMechanism selects the SASL mechanism: "PLAIN", "SCRAM-SHA-256",
+	// "SCRAM-SHA-512", or "" to disable SASL.
+	SASLMechanism string
+	Username      string
+	Password      string
+
+	// TLSEnabled switches the broker connection to TLS.
+	TLSEnabled bool
+
+	// CertPath is the path to the CA certificate used to verify the broker.
+	CertPath string
+
+	// ClientCertPath and ClientKeyPath are the paths to the client
+	// certificate/key pair used for mutual TLS. Both must be set to enable it.
+	ClientCertPath string
+	ClientKeyPath  string
+
+	// InsecureSkipVerify disables broker certificate verification. Only
+	// meant for local development against self-signed brokers.
+	InsecureSkipVerify bool
+}
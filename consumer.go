@@ -18,6 +18,10 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -74,11 +78,33 @@ type Consumer interface {
 type KafkaConsumer struct {
 	Configuration                        BrokerConfiguration
 	ConsumerGroup                        sarama.ConsumerGroup
+	Client                               sarama.Client
 	numberOfSuccessfullyConsumedMessages uint64
 	numberOfErrorsConsumingMessages      uint64
 	Verbose                              bool
 	Ready                                chan bool
 	Cancel                               context.CancelFunc
+	ctx                                  context.Context
+
+	// ForwarderConfiguration, when Enabled, switches ConsumeClaim into the
+	// read-process-write exactly-once mode: messages are transformed and
+	// forwarded to an output topic atomically with the offset commit,
+	// instead of being marked via session.MarkMessage.
+	ForwarderConfiguration TransactionalForwarderConfiguration
+
+	// Upstream, Closer and Closed are set up by CreateConsumerChannels. When
+	// Upstream is non-nil and ForwarderConfiguration is not Enabled,
+	// ConsumeClaim dispatches claimed messages to it instead of calling
+	// HandleMessage synchronously.
+	Upstream chan *sarama.ConsumerMessage
+	Closer   chan struct{}
+	Closed   chan struct{}
+
+	partitionTrackers sync.Map
+
+	stateMu sync.Mutex
+	ready   bool
+	failed  bool
 }
 
 // DefaultSaramaConfig is a config which will be used by default
@@ -101,6 +127,32 @@ func NewWithSaramaConfig(
 		saramaConfig = sarama.NewConfig()
 		saramaConfig.Version = sarama.V0_10_2_0
 
+		if brokerCfg.KafkaVersion != "" {
+			version, err := sarama.ParseKafkaVersion(brokerCfg.KafkaVersion)
+			if err != nil {
+				return nil, err
+			}
+			saramaConfig.Version = version
+		}
+
+		strategy, err := assignorStrategy(brokerCfg.Assignor)
+		if err != nil {
+			return nil, err
+		}
+		saramaConfig.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{strategy}
+
+		if brokerCfg.Oldest {
+			saramaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+		} else {
+			saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+		}
+
+		if brokerCfg.Security != nil {
+			if err := configureSecurity(saramaConfig, *brokerCfg.Security); err != nil {
+				return nil, err
+			}
+		}
+
 		/* TODO: we need to do it in production code
 		if brokerCfg.Timeout > 0 {
 			saramaConfig.Net.DialTimeout = brokerCfg.Timeout
@@ -115,7 +167,12 @@ func NewWithSaramaConfig(
 		Str("group", brokerCfg.Group).
 		Msg("Configuration")
 
-	consumerGroup, err := sarama.NewConsumerGroup([]string{brokerCfg.Address}, brokerCfg.Group, saramaConfig)
+	client, err := sarama.NewClient([]string{brokerCfg.Address}, saramaConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	consumerGroup, err := sarama.NewConsumerGroupFromClient(brokerCfg.Group, client)
 	if err != nil {
 		return nil, err
 	}
@@ -123,6 +180,7 @@ func NewWithSaramaConfig(
 	consumer := &KafkaConsumer{
 		Configuration:                        brokerCfg,
 		ConsumerGroup:                        consumerGroup,
+		Client:                               client,
 		Verbose:                              verbose,
 		numberOfSuccessfullyConsumedMessages: 0,
 		numberOfErrorsConsumingMessages:      0,
@@ -132,10 +190,38 @@ func NewWithSaramaConfig(
 	return consumer, nil
 }
 
+// assignorStrategy maps a configured assignor name to the matching sarama
+// balance strategy. An empty name defaults to "range". Unknown names are
+// rejected with a clear error so that a configuration typo fails fast at
+// startup instead of silently falling back to the default.
+func assignorStrategy(name string) (sarama.BalanceStrategy, error) {
+	switch name {
+	case "", "range":
+		return sarama.BalanceStrategyRange, nil
+	case "roundrobin":
+		return sarama.BalanceStrategyRoundRobin, nil
+	case "sticky":
+		return sarama.BalanceStrategySticky, nil
+	default:
+		return nil, fmt.Errorf("unknown partition assignor: %s", name)
+	}
+}
+
 // Serve starts listening for messages and processing them. It blocks current thread.
 func (consumer *KafkaConsumer) Serve() {
 	ctx, cancel := context.WithCancel(context.Background())
 	consumer.Cancel = cancel
+	consumer.ctx = ctx
+
+	if !consumer.ForwarderConfiguration.Enabled && consumer.Configuration.KafkaParallelMessages > 0 {
+		consumer.CreateConsumerChannels(consumer.Configuration.KafkaParallelMessages)
+	}
+
+	consumer.StartSignalHandler(ctx)
+
+	if consumer.Configuration.Monitoring.Address != "" {
+		consumer.StartMonitoringServer(ctx, consumer.Configuration.Monitoring)
+	}
 
 	go func() {
 		for {
@@ -143,7 +229,8 @@ func (consumer *KafkaConsumer) Serve() {
 			// server-side rebalance happens, the consumer session will need to be
 			// recreated to get the new claims
 			if err := consumer.ConsumerGroup.Consume(ctx, []string{consumer.Configuration.Topic}, consumer); err != nil {
-				log.Fatal().Err(err).Msg("Unable to recreate Kafka session")
+				consumer.setFailed(true)
+				log.Error().Err(err).Msg("Unable to recreate Kafka session")
 			}
 
 			// check if context was cancelled, signaling that the consumer should stop
@@ -172,13 +259,51 @@ func (consumer *KafkaConsumer) Serve() {
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *KafkaConsumer) Setup(sarama.ConsumerGroupSession) error {
+func (consumer *KafkaConsumer) Setup(session sarama.ConsumerGroupSession) error {
 	log.Info().Msg("New session has been setup")
-	// Mark the consumer as ready
+
+	if consumer.Configuration.OffsetsInitTimeout > 0 {
+		if err := consumer.WaitForOffsetsInitialized(session, consumer.Configuration.OffsetsInitTimeout); err != nil {
+			return err
+		}
+	}
+
+	// Mark the consumer as ready and, since a session only reaches Setup once
+	// ConsumerGroup.Consume has joined the group successfully, clear any
+	// failure recorded by a previous session.
 	close(consumer.Ready)
+	consumer.setReady(true)
+	consumer.setFailed(false)
 	return nil
 }
 
+// isReady reports whether Ready has closed at least once since the consumer
+// was created.
+func (consumer *KafkaConsumer) isReady() bool {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+	return consumer.ready
+}
+
+func (consumer *KafkaConsumer) setReady(ready bool) {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+	consumer.ready = ready
+}
+
+// isFailed reports whether the consumer group has been marked as failed.
+func (consumer *KafkaConsumer) isFailed() bool {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+	return consumer.failed
+}
+
+func (consumer *KafkaConsumer) setFailed(failed bool) {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+	consumer.failed = failed
+}
+
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
 func (consumer *KafkaConsumer) Cleanup(sarama.ConsumerGroupSession) error {
 	log.Info().Msg("New session has been finished")
@@ -191,6 +316,14 @@ func (consumer *KafkaConsumer) ConsumeClaim(session sarama.ConsumerGroupSession,
 		Int64(offsetKey, claim.InitialOffset()).
 		Msg("Starting messages loop")
 
+	if consumer.ForwarderConfiguration.Enabled {
+		return consumer.consumeClaimTransactionally(session, claim)
+	}
+
+	if consumer.Upstream != nil {
+		return consumer.consumeClaimParallel(session, claim)
+	}
+
 	for message := range claim.Messages() {
 		// not needed ATM, to be loged in consumer.HandleMessage
 		// log.Info().Int64(offsetKey, message.Offset).Msg("Message retrieved")
@@ -203,12 +336,109 @@ func (consumer *KafkaConsumer) ConsumeClaim(session sarama.ConsumerGroupSession,
 	return nil
 }
 
+// consumeClaimTransactionally implements the read-process-write exactly-once
+// path: every batch of claimed messages is forwarded to the configured
+// output topic and its offsets committed atomically via a
+// TransactionalForwarder. session.MarkMessage is never called in this mode,
+// since the input offsets are committed as part of the transaction itself;
+// session is instead threaded through to ForwardAndCommit so a failed batch
+// can reset the consumer group's offset back to where it needs to be
+// reprocessed from.
+func (consumer *KafkaConsumer) consumeClaimTransactionally(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	forwarder, err := NewTransactionalForwarder(consumer.Configuration, claim.Partition(), consumer.ForwarderConfiguration)
+	if err != nil {
+		return err
+	}
+	defer forwarder.Close()
+
+	messages := claim.Messages()
+
+	for {
+		batch, more := collectBatch(messages, consumer.ForwarderConfiguration.BatchSize, consumer.ForwarderConfiguration.BatchTimeout)
+
+		if len(batch) > 0 {
+			startTime := time.Now()
+			err := forwarder.ForwardAndCommit(session, consumer.Configuration.Group, batch)
+			messageProcessingDuration := time.Since(startTime).Seconds()
+
+			if err != nil {
+				atomic.AddUint64(&consumer.numberOfErrorsConsumingMessages, uint64(len(batch)))
+				numberOfErrorsConsumingMessagesMetric.Add(float64(len(batch)))
+
+				log.Error().
+					Err(err).
+					Int32(partitionKey, claim.Partition()).
+					Int("batch_size", len(batch)).
+					Msg("Unable to forward message batch transactionally")
+				return err
+			}
+
+			atomic.AddUint64(&consumer.numberOfSuccessfullyConsumedMessages, uint64(len(batch)))
+			numberOfSuccessfullyConsumedMessagesMetric.Add(float64(len(batch)))
+
+			last := batch[len(batch)-1]
+			partitionOffsetMetric.WithLabelValues(strconv.Itoa(int(last.Partition))).Set(float64(last.Offset))
+			messageProcessingDurationMetric.Observe(messageProcessingDuration)
+		}
+
+		if !more {
+			return nil
+		}
+	}
+}
+
+// collectBatch reads at least one message from messages, then keeps
+// accumulating up to batchSize messages as long as they arrive before
+// timeout elapses, so that ConsumeClaim commits real batches instead of
+// paying a transaction round trip per message. It returns false once
+// messages has been closed, after delivering whatever was left in it.
+func collectBatch(messages <-chan *sarama.ConsumerMessage, batchSize int, timeout time.Duration) ([]*sarama.ConsumerMessage, bool) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	if timeout <= 0 {
+		timeout = defaultTransactionalBatchTimeout
+	}
+
+	first, ok := <-messages
+	if !ok {
+		return nil, false
+	}
+
+	batch := make([]*sarama.ConsumerMessage, 0, batchSize)
+	batch = append(batch, first)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for len(batch) < batchSize {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, message)
+		case <-timer.C:
+			return batch, true
+		}
+	}
+
+	return batch, true
+}
+
 // Close method closes all resources used by consumer
 func (consumer *KafkaConsumer) Close() error {
 	if consumer.Cancel != nil {
 		consumer.Cancel()
 	}
 
+	// The consumer group must be closed (ending every in-flight session and
+	// the ConsumeClaim goroutines dispatching into Upstream) before the
+	// worker pool is torn down below. Otherwise a ConsumeClaim goroutine
+	// still blocked sending into a full Upstream channel would never return,
+	// ConsumerGroup.Close() would then hang waiting for that session to
+	// finish, and this whole method would deadlock.
 	if consumer.ConsumerGroup != nil {
 		if err := consumer.ConsumerGroup.Close(); err != nil {
 			log.Error().
@@ -217,19 +447,32 @@ func (consumer *KafkaConsumer) Close() error {
 		}
 	}
 
+	if consumer.Closer != nil {
+		close(consumer.Closer)
+		<-consumer.Closed
+	}
+
+	if consumer.Client != nil {
+		if err := consumer.Client.Close(); err != nil {
+			log.Error().
+				Err(err).
+				Msg("Unable to close Kafka client")
+		}
+	}
+
 	return nil
 }
 
 // GetNumberOfSuccessfullyConsumedMessages returns number of consumed messages
 // since creating KafkaConsumer obj
 func (consumer *KafkaConsumer) GetNumberOfSuccessfullyConsumedMessages() uint64 {
-	return consumer.numberOfSuccessfullyConsumedMessages
+	return atomic.LoadUint64(&consumer.numberOfSuccessfullyConsumedMessages)
 }
 
 // GetNumberOfErrorsConsumingMessages returns number of errors during consuming messages
 // since creating KafkaConsumer obj
 func (consumer *KafkaConsumer) GetNumberOfErrorsConsumingMessages() uint64 {
-	return consumer.numberOfErrorsConsumingMessages
+	return atomic.LoadUint64(&consumer.numberOfErrorsConsumingMessages)
 }
 
 // HandleMessage handles the message and does all logging, metrics, etc
@@ -256,20 +499,25 @@ func (consumer *KafkaConsumer) HandleMessage(msg *sarama.ConsumerMessage) {
 		log.Error().
 			Err(err).
 			Msg("Error processing message consumed from Kafka")
-		consumer.numberOfErrorsConsumingMessages++
+		atomic.AddUint64(&consumer.numberOfErrorsConsumingMessages, 1)
+		numberOfErrorsConsumingMessagesMetric.Inc()
 	} else {
 		// The message was processed successfully.
-		consumer.numberOfSuccessfullyConsumedMessages++
+		atomic.AddUint64(&consumer.numberOfSuccessfullyConsumedMessages, 1)
+		numberOfSuccessfullyConsumedMessagesMetric.Inc()
 	}
 
+	partitionOffsetMetric.WithLabelValues(strconv.Itoa(int(msg.Partition))).Set(float64(msg.Offset))
+	messageProcessingDurationMetric.Observe(messageProcessingDuration)
+
 	log.Info().
 		Str(topicKey, consumer.Configuration.Topic).
 		Str(groupKey, consumer.Configuration.Group).
 		Int64(offsetKey, msg.Offset).
 		Int32(partitionKey, msg.Partition).
 		Str(topicKey, msg.Topic).
-		Uint64("consumed messages", consumer.numberOfSuccessfullyConsumedMessages).
-		Uint64("errors", consumer.numberOfErrorsConsumingMessages).
+		Uint64("consumed messages", atomic.LoadUint64(&consumer.numberOfSuccessfullyConsumedMessages)).
+		Uint64("errors", atomic.LoadUint64(&consumer.numberOfErrorsConsumingMessages)).
 		Msgf("Processing of message took '%v' seconds", messageProcessingDuration)
 }
 
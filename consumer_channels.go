@@ -0,0 +1,150 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// CreateConsumerChannels sets up the Upstream dispatch channel (buffered to
+// batchSize) and starts KafkaParallelMessages worker goroutines that drain it
+// and invoke ProcessMessage via HandleMessage. It returns the Upstream
+// channel together with a Closer channel, closing which tells the workers to
+// stop, and a Closed channel, which is closed once every worker has returned.
+// Workers stop as soon as Closer fires, so messages still buffered in
+// Upstream at that point are not processed. Tests and embedders can use the returned Upstream
+// channel to inject or observe messages without a live broker.
+func (consumer *KafkaConsumer) CreateConsumerChannels(batchSize int) (chan *sarama.ConsumerMessage, chan struct{}, chan struct{}) {
+	consumer.Upstream = make(chan *sarama.ConsumerMessage, batchSize)
+	consumer.Closer = make(chan struct{})
+	consumer.Closed = make(chan struct{})
+
+	parallelism := consumer.Configuration.KafkaParallelMessages
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	var workers sync.WaitGroup
+	workers.Add(parallelism)
+
+	for i := 0; i < parallelism; i++ {
+		go func() {
+			defer workers.Done()
+			consumer.runUpstreamWorker()
+		}()
+	}
+
+	go func() {
+		workers.Wait()
+		close(consumer.Closed)
+	}()
+
+	return consumer.Upstream, consumer.Closer, consumer.Closed
+}
+
+// runUpstreamWorker drains Upstream until it is closed or Closer fires,
+// processing every message and acknowledging it against the partition
+// tracker registered for its partition.
+func (consumer *KafkaConsumer) runUpstreamWorker() {
+	for {
+		select {
+		case message, ok := <-consumer.Upstream:
+			if !ok {
+				return
+			}
+
+			consumer.HandleMessage(message)
+
+			if tracker, ok := consumer.partitionTrackers.Load(message.Partition); ok {
+				tracker.(*partitionOffsetTracker).ack(message)
+			}
+		case <-consumer.Closer:
+			return
+		}
+	}
+}
+
+// consumeClaimParallel dispatches every message claimed for this partition to
+// the shared Upstream channel instead of calling HandleMessage synchronously,
+// so that the worker pool started by CreateConsumerChannels can process
+// messages from all claimed partitions in parallel. A partitionOffsetTracker
+// is registered for the lifetime of the claim so that session.MarkMessage is
+// only called once all earlier offsets in this partition have been
+// acknowledged by workers, preserving at-least-once semantics. Before the
+// tracker is unregistered, consumeClaimParallel waits for every message it
+// dispatched to be acknowledged, so a rebalance can never hand this partition
+// to a new claim/tracker while a worker still holds a stale reference to this
+// one.
+func (consumer *KafkaConsumer) consumeClaimParallel(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	tracker := &partitionOffsetTracker{
+		acked:    make(map[int64]bool),
+		nextMark: claim.InitialOffset(),
+		session:  session,
+		claim:    claim,
+	}
+	consumer.partitionTrackers.Store(claim.Partition(), tracker)
+
+	for message := range claim.Messages() {
+		tracker.inFlight.Add(1)
+
+		select {
+		case consumer.Upstream <- message:
+		case <-consumer.Closer:
+			tracker.inFlight.Done()
+		}
+	}
+
+	tracker.inFlight.Wait()
+	consumer.partitionTrackers.Delete(claim.Partition())
+
+	return nil
+}
+
+// partitionOffsetTracker tracks in-flight message offsets for a single
+// partition claim so that offsets are only marked once every earlier message
+// in that partition has been acknowledged by a worker, even though workers
+// may finish processing messages out of order. inFlight counts messages that
+// have been dispatched to Upstream but not yet acknowledged, so the owning
+// claim can wait for it to drain before releasing the tracker.
+type partitionOffsetTracker struct {
+	mu       sync.Mutex
+	acked    map[int64]bool
+	nextMark int64
+	session  sarama.ConsumerGroupSession
+	claim    sarama.ConsumerGroupClaim
+	inFlight sync.WaitGroup
+}
+
+// ack records that message has been processed by a worker and advances
+// nextMark (calling session.MarkOffset for every offset that becomes safe to
+// commit) as far as the contiguous run of acknowledged offsets allows.
+func (tracker *partitionOffsetTracker) ack(message *sarama.ConsumerMessage) {
+	defer tracker.inFlight.Done()
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.acked[message.Offset] = true
+
+	for tracker.acked[tracker.nextMark] {
+		delete(tracker.acked, tracker.nextMark)
+		tracker.nextMark++
+		tracker.session.MarkOffset(tracker.claim.Topic(), tracker.claim.Partition(), tracker.nextMark, "")
+	}
+}
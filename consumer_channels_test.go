@@ -0,0 +1,113 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// markCall records a single session.MarkOffset invocation observed by fakeSession.
+type markCall struct {
+	topic     string
+	partition int32
+	offset    int64
+}
+
+// fakeSession is a minimal sarama.ConsumerGroupSession that only records
+// MarkOffset/ResetOffset calls, for testing partitionOffsetTracker and
+// TransactionalForwarder in isolation.
+type fakeSession struct {
+	marks  []markCall
+	resets []markCall
+}
+
+func (f *fakeSession) Claims() map[string][]int32 { return nil }
+func (f *fakeSession) MemberID() string           { return "" }
+func (f *fakeSession) GenerationID() int32        { return 0 }
+func (f *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	f.marks = append(f.marks, markCall{topic: topic, partition: partition, offset: offset})
+}
+func (f *fakeSession) Commit() {}
+func (f *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+	f.resets = append(f.resets, markCall{topic: topic, partition: partition, offset: offset})
+}
+func (f *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {}
+func (f *fakeSession) Context() context.Context                                 { return context.Background() }
+
+// fakeClaim is a minimal sarama.ConsumerGroupClaim fixed to a single topic/partition.
+type fakeClaim struct {
+	topic     string
+	partition int32
+}
+
+func (f *fakeClaim) Topic() string                            { return f.topic }
+func (f *fakeClaim) Partition() int32                         { return f.partition }
+func (f *fakeClaim) InitialOffset() int64                     { return 0 }
+func (f *fakeClaim) HighWaterMarkOffset() int64               { return 0 }
+func (f *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return nil }
+
+// TestPartitionOffsetTrackerAckOutOfOrder checks that ack only advances
+// (and marks) the contiguous run of acknowledged offsets, so an
+// out-of-order completion never marks past a gap.
+func TestPartitionOffsetTrackerAckOutOfOrder(t *testing.T) {
+	session := &fakeSession{}
+	claim := &fakeClaim{topic: "test-topic", partition: 3}
+
+	tracker := &partitionOffsetTracker{
+		acked:    make(map[int64]bool),
+		nextMark: 10,
+		session:  session,
+		claim:    claim,
+	}
+
+	messages := []*sarama.ConsumerMessage{
+		{Topic: "test-topic", Partition: 3, Offset: 11},
+		{Topic: "test-topic", Partition: 3, Offset: 10},
+		{Topic: "test-topic", Partition: 3, Offset: 12},
+	}
+
+	for range messages {
+		tracker.inFlight.Add(1)
+	}
+
+	// Offset 11 completes before offset 10: nothing can be marked yet
+	// because offset 10 is still missing.
+	tracker.ack(messages[0])
+	assert.Empty(t, session.marks)
+
+	// Offset 10 arrives: it closes the gap, so both 10 and 11 become
+	// markable in the same call.
+	tracker.ack(messages[1])
+	assert.Equal(t, []markCall{
+		{topic: "test-topic", partition: 3, offset: 11},
+		{topic: "test-topic", partition: 3, offset: 12},
+	}, session.marks)
+
+	// Offset 12 completes the run.
+	tracker.ack(messages[2])
+	assert.Equal(t, []markCall{
+		{topic: "test-topic", partition: 3, offset: 11},
+		{topic: "test-topic", partition: 3, offset: 12},
+		{topic: "test-topic", partition: 3, offset: 13},
+	}, session.marks)
+
+	tracker.inFlight.Wait()
+}
@@ -0,0 +1,56 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAssignorStrategy checks that assignorStrategy maps known assignor
+// names to the matching sarama balance strategy and rejects unknown ones.
+func TestAssignorStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		assignor string
+		expected sarama.BalanceStrategy
+	}{
+		{"empty defaults to range", "", sarama.BalanceStrategyRange},
+		{"range", "range", sarama.BalanceStrategyRange},
+		{"roundrobin", "roundrobin", sarama.BalanceStrategyRoundRobin},
+		{"sticky", "sticky", sarama.BalanceStrategySticky},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := assignorStrategy(tt.assignor)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, strategy)
+		})
+	}
+}
+
+// TestAssignorStrategyUnknown checks that an unrecognized assignor name is
+// rejected with a clear error instead of silently falling back to a default.
+func TestAssignorStrategyUnknown(t *testing.T) {
+	strategy, err := assignorStrategy("not-a-real-assignor")
+
+	assert.Error(t, err)
+	assert.Nil(t, strategy)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// MonitoringConfiguration configures the health/metrics HTTP endpoint served
+// alongside KafkaConsumer.Serve.
+type MonitoringConfiguration struct {
+	Address string
+}
+
+var (
+	// numberOfSuccessfullyConsumedMessagesMetric mirrors
+	// KafkaConsumer.numberOfSuccessfullyConsumedMessages as a Prometheus counter.
+	numberOfSuccessfullyConsumedMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kafka_monitor_messages_consumed_total",
+		Help: "Total number of successfully consumed Kafka messages.",
+	})
+
+	// numberOfErrorsConsumingMessagesMetric mirrors
+	// KafkaConsumer.numberOfErrorsConsumingMessages as a Prometheus counter.
+	numberOfErrorsConsumingMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kafka_monitor_messages_consuming_errors_total",
+		Help: "Total number of errors encountered while consuming Kafka messages.",
+	})
+
+	partitionOffsetMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_monitor_partition_offset",
+		Help: "Current offset of the last message processed, per partition.",
+	}, []string{partitionKey})
+
+	messageProcessingDurationMetric = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "kafka_monitor_message_processing_duration_seconds",
+		Help: "Time spent processing a single Kafka message, or a whole batch when forwarding transactionally.",
+	})
+)
+
+// StartSignalHandler installs a SIGUSR1 handler that toggles the consumer
+// group between paused and resumed on every signal received, logging the
+// transition. The handler runs until ctx is cancelled.
+func (consumer *KafkaConsumer) StartSignalHandler(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		paused := false
+
+		for {
+			select {
+			case <-signals:
+				paused = !paused
+
+				if paused {
+					consumer.ConsumerGroup.PauseAll()
+					log.Info().Msg("Consumer group paused via SIGUSR1")
+				} else {
+					consumer.ConsumerGroup.ResumeAll()
+					log.Info().Msg("Consumer group resumed via SIGUSR1")
+				}
+			case <-ctx.Done():
+				signal.Stop(signals)
+				return
+			}
+		}
+	}()
+}
+
+// StartMonitoringServer starts an HTTP server exposing /healthz, /ready and
+// /metrics on the configured address. The server is shut down cleanly once
+// ctx is cancelled.
+func (consumer *KafkaConsumer) StartMonitoringServer(ctx context.Context, monitoringCfg MonitoringConfiguration) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", consumer.healthzHandler)
+	mux.HandleFunc("/ready", consumer.readyHandler)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:    monitoringCfg.Address,
+		Handler: mux,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Monitoring HTTP server failed")
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Error().Err(err).Msg("Unable to shut down monitoring HTTP server")
+		}
+	}()
+
+	return server
+}
+
+// healthzHandler reports the process as healthy once Ready has closed at
+// least once and the consumer group has not been marked as failed.
+func (consumer *KafkaConsumer) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	if !consumer.isReady() || consumer.isFailed() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// readyHandler reports the same readiness state as healthzHandler, exposed
+// separately so liveness and readiness probes can be configured independently.
+func (consumer *KafkaConsumer) readyHandler(w http.ResponseWriter, _ *http.Request) {
+	if !consumer.isReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHealthzHandler checks that healthzHandler reports unhealthy until the
+// consumer has become ready, reports unhealthy again once the consumer group
+// has been marked as failed, and reports healthy otherwise.
+func TestHealthzHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		ready    bool
+		failed   bool
+		expected int
+	}{
+		{"not ready yet", false, false, http.StatusServiceUnavailable},
+		{"ready and failed", true, true, http.StatusServiceUnavailable},
+		{"ready and healthy", true, false, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer := &KafkaConsumer{}
+			consumer.setReady(tt.ready)
+			consumer.setFailed(tt.failed)
+
+			recorder := httptest.NewRecorder()
+			consumer.healthzHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			assert.Equal(t, tt.expected, recorder.Code)
+		})
+	}
+}
+
+// TestReadyHandler checks that readyHandler only tracks isReady, ignoring
+// the failed state that healthzHandler also considers.
+func TestReadyHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		ready    bool
+		failed   bool
+		expected int
+	}{
+		{"not ready yet", false, false, http.StatusServiceUnavailable},
+		{"ready but failed", true, true, http.StatusOK},
+		{"ready and healthy", true, false, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer := &KafkaConsumer{}
+			consumer.setReady(tt.ready)
+			consumer.setFailed(tt.failed)
+
+			recorder := httptest.NewRecorder()
+			consumer.readyHandler(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+			assert.Equal(t, tt.expected, recorder.Code)
+		})
+	}
+}
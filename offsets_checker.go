@@ -0,0 +1,140 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rs/zerolog/log"
+)
+
+// offsetsInitializedPollInterval is how often WaitForOffsetsInitialized
+// re-checks committed offsets while waiting for the consumer group to catch up.
+const offsetsInitializedPollInterval = 200 * time.Millisecond
+
+// topicPartition identifies a single claimed partition.
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// WaitForOffsetsInitialized blocks until every partition assigned to session
+// has either a committed consumer-group offset or an empty (zero
+// high-water-mark) topic, so that the readiness signaled by closing
+// consumer.Ready is actually backed by tracked offsets. It returns an error
+// if timeout elapses first or if the consumer's context (the one created by
+// Serve, or context.Background() when Serve has not run) is cancelled, in
+// which case the caller (Setup) should abort the session. A
+// PartitionOffsetManager is opened once per claimed partition and reused for
+// every poll instead of being reopened on each tick.
+func (consumer *KafkaConsumer) WaitForOffsetsInitialized(session sarama.ConsumerGroupSession, timeout time.Duration) error {
+	ctx := consumer.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	deadlineCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	offsetManager, err := sarama.NewOffsetManagerFromClient(consumer.Configuration.Group, consumer.Client)
+	if err != nil {
+		return err
+	}
+	defer offsetManager.Close()
+
+	partitionManagers, err := managePartitions(offsetManager, session.Claims())
+	defer closePartitionManagers(partitionManagers)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(offsetsInitializedPollInterval)
+	defer ticker.Stop()
+
+	for {
+		initialized, err := consumer.offsetsInitialized(partitionManagers)
+		if err != nil {
+			return err
+		}
+		if initialized {
+			return nil
+		}
+
+		select {
+		case <-deadlineCtx.Done():
+			return fmt.Errorf("timed out waiting for consumer-group offsets to be initialized: %w", deadlineCtx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// managePartitions opens a PartitionOffsetManager for every partition in
+// claims, to be reused across polls. On error it returns the managers it had
+// already opened together with the error, so the caller can close them.
+func managePartitions(offsetManager sarama.OffsetManager, claims map[string][]int32) (map[topicPartition]sarama.PartitionOffsetManager, error) {
+	managers := make(map[topicPartition]sarama.PartitionOffsetManager)
+
+	for topic, partitions := range claims {
+		for _, partition := range partitions {
+			partitionOffsetManager, err := offsetManager.ManagePartition(topic, partition)
+			if err != nil {
+				return managers, err
+			}
+
+			managers[topicPartition{topic: topic, partition: partition}] = partitionOffsetManager
+		}
+	}
+
+	return managers, nil
+}
+
+// closePartitionManagers closes every PartitionOffsetManager opened by
+// managePartitions, logging (rather than failing on) close errors since it
+// always runs as cleanup.
+func closePartitionManagers(managers map[topicPartition]sarama.PartitionOffsetManager) {
+	for _, manager := range managers {
+		if err := manager.Close(); err != nil {
+			log.Error().Err(err).Msg("Unable to close partition offset manager")
+		}
+	}
+}
+
+// offsetsInitialized reports whether every partition in managers either has
+// a committed offset for the consumer group, or is an empty topic
+// (high-water-mark 0).
+func (consumer *KafkaConsumer) offsetsInitialized(managers map[topicPartition]sarama.PartitionOffsetManager) (bool, error) {
+	for tp, manager := range managers {
+		committedOffset, _ := manager.NextOffset()
+		if committedOffset > -1 {
+			continue
+		}
+
+		highWaterMark, err := consumer.Client.GetOffset(tp.topic, tp.partition, sarama.OffsetNewest)
+		if err != nil {
+			return false, err
+		}
+
+		if highWaterMark != 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
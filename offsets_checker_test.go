@@ -0,0 +1,176 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePartitionOffsetManager is a minimal sarama.PartitionOffsetManager that
+// only serves a fixed NextOffset, for testing offsetsInitialized without a
+// live broker.
+type fakePartitionOffsetManager struct {
+	nextOffset int64
+}
+
+func (f *fakePartitionOffsetManager) NextOffset() (int64, string)          { return f.nextOffset, "" }
+func (f *fakePartitionOffsetManager) MarkOffset(int64, string)             {}
+func (f *fakePartitionOffsetManager) ResetOffset(int64, string)            {}
+func (f *fakePartitionOffsetManager) Errors() <-chan *sarama.ConsumerError { return nil }
+func (f *fakePartitionOffsetManager) AsyncClose()                          {}
+func (f *fakePartitionOffsetManager) Close() error                         { return nil }
+
+// fakeClient is a minimal sarama.Client that only serves a fixed GetOffset
+// result, for testing offsetsInitialized without a live broker. Every other
+// method is an unused stub required to satisfy the interface.
+type fakeClient struct {
+	highWaterMark int64
+	getOffsetErr  error
+}
+
+func (f *fakeClient) Config() *sarama.Config                       { return nil }
+func (f *fakeClient) Controller() (*sarama.Broker, error)          { return nil, nil }
+func (f *fakeClient) RefreshController() (*sarama.Broker, error)   { return nil, nil }
+func (f *fakeClient) Brokers() []*sarama.Broker                    { return nil }
+func (f *fakeClient) Broker(int32) (*sarama.Broker, error)         { return nil, nil }
+func (f *fakeClient) Topics() ([]string, error)                    { return nil, nil }
+func (f *fakeClient) Partitions(string) ([]int32, error)           { return nil, nil }
+func (f *fakeClient) WritablePartitions(string) ([]int32, error)   { return nil, nil }
+func (f *fakeClient) Leader(string, int32) (*sarama.Broker, error) { return nil, nil }
+func (f *fakeClient) LeaderAndEpoch(string, int32) (*sarama.Broker, int32, error) {
+	return nil, 0, nil
+}
+func (f *fakeClient) Replicas(string, int32) ([]int32, error)        { return nil, nil }
+func (f *fakeClient) InSyncReplicas(string, int32) ([]int32, error)  { return nil, nil }
+func (f *fakeClient) OfflineReplicas(string, int32) ([]int32, error) { return nil, nil }
+func (f *fakeClient) RefreshBrokers([]string) error                  { return nil }
+func (f *fakeClient) RefreshMetadata(...string) error                { return nil }
+func (f *fakeClient) GetOffset(string, int32, int64) (int64, error) {
+	return f.highWaterMark, f.getOffsetErr
+}
+func (f *fakeClient) Coordinator(string) (*sarama.Broker, error)            { return nil, nil }
+func (f *fakeClient) RefreshCoordinator(string) error                       { return nil }
+func (f *fakeClient) TransactionCoordinator(string) (*sarama.Broker, error) { return nil, nil }
+func (f *fakeClient) RefreshTransactionCoordinator(string) error            { return nil }
+func (f *fakeClient) InitProducerID() (*sarama.InitProducerIDResponse, error) {
+	return nil, nil
+}
+func (f *fakeClient) LeastLoadedBroker() *sarama.Broker { return nil }
+func (f *fakeClient) Close() error                      { return nil }
+func (f *fakeClient) Closed() bool                      { return false }
+
+// TestOffsetsInitializedCommittedOffset checks that a partition with a
+// committed consumer-group offset is considered initialized without
+// consulting the high-water-mark at all.
+func TestOffsetsInitializedCommittedOffset(t *testing.T) {
+	consumer := &KafkaConsumer{Client: &fakeClient{getOffsetErr: errors.New("should not be called")}}
+	managers := map[topicPartition]sarama.PartitionOffsetManager{
+		{topic: "test-topic", partition: 0}: &fakePartitionOffsetManager{nextOffset: 42},
+	}
+
+	initialized, err := consumer.offsetsInitialized(managers)
+
+	assert.NoError(t, err)
+	assert.True(t, initialized)
+}
+
+// TestOffsetsInitializedEmptyTopic checks that a partition with no committed
+// offset is still considered initialized if the topic is empty.
+func TestOffsetsInitializedEmptyTopic(t *testing.T) {
+	consumer := &KafkaConsumer{Client: &fakeClient{highWaterMark: 0}}
+	managers := map[topicPartition]sarama.PartitionOffsetManager{
+		{topic: "test-topic", partition: 0}: &fakePartitionOffsetManager{nextOffset: -1},
+	}
+
+	initialized, err := consumer.offsetsInitialized(managers)
+
+	assert.NoError(t, err)
+	assert.True(t, initialized)
+}
+
+// TestOffsetsInitializedPendingCommit checks that a partition with no
+// committed offset and a non-empty topic is reported as not yet initialized.
+func TestOffsetsInitializedPendingCommit(t *testing.T) {
+	consumer := &KafkaConsumer{Client: &fakeClient{highWaterMark: 7}}
+	managers := map[topicPartition]sarama.PartitionOffsetManager{
+		{topic: "test-topic", partition: 0}: &fakePartitionOffsetManager{nextOffset: -1},
+	}
+
+	initialized, err := consumer.offsetsInitialized(managers)
+
+	assert.NoError(t, err)
+	assert.False(t, initialized)
+}
+
+// TestOffsetsInitializedGetOffsetError checks that a GetOffset failure is
+// propagated rather than treated as "not yet initialized".
+func TestOffsetsInitializedGetOffsetError(t *testing.T) {
+	consumer := &KafkaConsumer{Client: &fakeClient{getOffsetErr: errors.New("boom")}}
+	managers := map[topicPartition]sarama.PartitionOffsetManager{
+		{topic: "test-topic", partition: 0}: &fakePartitionOffsetManager{nextOffset: -1},
+	}
+
+	_, err := consumer.offsetsInitialized(managers)
+
+	assert.Error(t, err)
+}
+
+// fakeOffsetManager is a minimal sarama.OffsetManager that hands out
+// fakePartitionOffsetManagers, optionally failing on a configured partition,
+// for testing managePartitions without a live broker.
+type fakeOffsetManager struct {
+	failPartition int32
+	failErr       error
+}
+
+func (f *fakeOffsetManager) ManagePartition(_ string, partition int32) (sarama.PartitionOffsetManager, error) {
+	if f.failErr != nil && partition == f.failPartition {
+		return nil, f.failErr
+	}
+	return &fakePartitionOffsetManager{nextOffset: -1}, nil
+}
+func (f *fakeOffsetManager) Close() error { return nil }
+func (f *fakeOffsetManager) Commit()      {}
+
+// TestManagePartitionsOpensEveryClaim checks that managePartitions opens
+// exactly one PartitionOffsetManager per claimed topic/partition.
+func TestManagePartitionsOpensEveryClaim(t *testing.T) {
+	claims := map[string][]int32{"test-topic": {0, 1}}
+
+	managers, err := managePartitions(&fakeOffsetManager{}, claims)
+
+	assert.NoError(t, err)
+	assert.Len(t, managers, 2)
+	assert.Contains(t, managers, topicPartition{topic: "test-topic", partition: 0})
+	assert.Contains(t, managers, topicPartition{topic: "test-topic", partition: 1})
+}
+
+// TestManagePartitionsError checks that a failure opening one partition's
+// manager is returned alongside whatever managers were already opened, so
+// the caller can still close them during cleanup.
+func TestManagePartitionsError(t *testing.T) {
+	claims := map[string][]int32{"test-topic": {0}}
+
+	managers, err := managePartitions(&fakeOffsetManager{failPartition: 0, failErr: errors.New("boom")}, claims)
+
+	assert.Error(t, err)
+	assert.Empty(t, managers)
+}
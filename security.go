@@ -0,0 +1,134 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// configureSecurity populates saramaConfig's SASL and TLS settings from cfg.
+func configureSecurity(saramaConfig *sarama.Config, cfg SecurityConfiguration) error {
+	if cfg.SASLMechanism != "" {
+		saramaConfig.Net.SASL.Enable = true
+		saramaConfig.Net.SASL.User = cfg.Username
+		saramaConfig.Net.SASL.Password = cfg.Password
+
+		switch cfg.SASLMechanism {
+		case "PLAIN":
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case "SCRAM-SHA-256":
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = scramClientGenerator(sha256.New)
+		case "SCRAM-SHA-512":
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = scramClientGenerator(sha512.New)
+		default:
+			return fmt.Errorf("unknown SASL mechanism: %s", cfg.SASLMechanism)
+		}
+	}
+
+	if cfg.TLSEnabled {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+
+		saramaConfig.Net.TLS.Enable = true
+		saramaConfig.Net.TLS.Config = tlsConfig
+	}
+
+	return nil
+}
+
+// newTLSConfig loads the CA certificate and, if configured, the client
+// certificate/key pair referenced by cfg into a *tls.Config.
+func newTLSConfig(cfg SecurityConfiguration) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CertPath != "" {
+		caCert, err := os.ReadFile(cfg.CertPath)
+		if err != nil {
+			return nil, err
+		}
+
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("unable to parse CA certificate from %s", cfg.CertPath)
+		}
+
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if cfg.ClientCertPath != "" && cfg.ClientKeyPath != "" {
+		clientCert, err := tls.LoadX509KeyPair(cfg.ClientCertPath, cfg.ClientKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// scramClientGenerator builds the sarama.SCRAMClient generator function for
+// the given hash constructor, used for the SCRAM-SHA-256/512 mechanisms.
+func scramClientGenerator(hashGeneratorFcn scram.HashGeneratorFcn) func() sarama.SCRAMClient {
+	return func() sarama.SCRAMClient {
+		return &xdgSCRAMClient{HashGeneratorFcn: hashGeneratorFcn}
+	}
+}
+
+// xdgSCRAMClient implements sarama.SCRAMClient on top of the xdg-go/scram
+// client, as recommended by sarama's SASL/SCRAM documentation.
+type xdgSCRAMClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+// Begin starts a new SCRAM conversation for the given credentials.
+func (c *xdgSCRAMClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+
+	c.Client = client
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+// Step advances the SCRAM conversation with the broker's challenge.
+func (c *xdgSCRAMClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+// Done reports whether the SCRAM conversation has completed.
+func (c *xdgSCRAMClient) Done() bool {
+	return c.ClientConversation.Done()
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestConfigureSecuritySASLMechanisms checks that configureSecurity enables
+// SASL and selects the matching sarama mechanism for each supported value.
+func TestConfigureSecuritySASLMechanisms(t *testing.T) {
+	tests := []struct {
+		name      string
+		mechanism string
+		expected  sarama.SASLMechanism
+	}{
+		{"plain", "PLAIN", sarama.SASLTypePlaintext},
+		{"scram sha256", "SCRAM-SHA-256", sarama.SASLTypeSCRAMSHA256},
+		{"scram sha512", "SCRAM-SHA-512", sarama.SASLTypeSCRAMSHA512},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saramaConfig := sarama.NewConfig()
+
+			err := configureSecurity(saramaConfig, SecurityConfiguration{
+				SASLMechanism: tt.mechanism,
+				Username:      "user",
+				Password:      "pass",
+			})
+
+			assert.NoError(t, err)
+			assert.True(t, saramaConfig.Net.SASL.Enable)
+			assert.Equal(t, tt.expected, saramaConfig.Net.SASL.Mechanism)
+		})
+	}
+}
+
+// TestConfigureSecurityNoSASL checks that SASL stays disabled when no
+// mechanism is configured.
+func TestConfigureSecurityNoSASL(t *testing.T) {
+	saramaConfig := sarama.NewConfig()
+
+	err := configureSecurity(saramaConfig, SecurityConfiguration{})
+
+	assert.NoError(t, err)
+	assert.False(t, saramaConfig.Net.SASL.Enable)
+}
+
+// TestConfigureSecurityUnknownMechanism checks that an unsupported SASL
+// mechanism name is rejected with an error.
+func TestConfigureSecurityUnknownMechanism(t *testing.T) {
+	saramaConfig := sarama.NewConfig()
+
+	err := configureSecurity(saramaConfig, SecurityConfiguration{SASLMechanism: "bogus"})
+
+	assert.Error(t, err)
+}
+
+// TestConfigureSecurityTLS checks that configureSecurity enables TLS and
+// carries InsecureSkipVerify through to the resulting *tls.Config.
+func TestConfigureSecurityTLS(t *testing.T) {
+	saramaConfig := sarama.NewConfig()
+
+	err := configureSecurity(saramaConfig, SecurityConfiguration{
+		TLSEnabled:         true,
+		InsecureSkipVerify: true,
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, saramaConfig.Net.TLS.Enable)
+	assert.True(t, saramaConfig.Net.TLS.Config.InsecureSkipVerify)
+}
@@ -0,0 +1,218 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rs/zerolog/log"
+)
+
+// TransformFunc transforms one consumed message into zero or more messages to
+// be produced to the output topic as part of the same transaction as the
+// input message's offset commit.
+type TransformFunc func(msg *sarama.ConsumerMessage) ([]*sarama.ProducerMessage, error)
+
+// TransactionalForwarderConfiguration configures the read-process-write
+// exactly-once flow performed by TransactionalForwarder.
+type TransactionalForwarderConfiguration struct {
+	Enabled               bool
+	OutputTopic           string
+	TransactionalIDPrefix string
+	Transform             TransformFunc
+
+	// BatchSize is the maximum number of claimed messages committed
+	// together in a single transaction. Values less than 1 are treated as 1.
+	BatchSize int
+
+	// BatchTimeout bounds how long a batch waits for BatchSize messages to
+	// accumulate before being committed with whatever it has collected so
+	// far. Zero or negative defaults to defaultTransactionalBatchTimeout.
+	BatchTimeout time.Duration
+}
+
+// defaultTransactionalBatchTimeout is used when
+// TransactionalForwarderConfiguration.BatchTimeout is not set.
+const defaultTransactionalBatchTimeout = 100 * time.Millisecond
+
+// TransactionalForwarder wraps a transactional sarama.AsyncProducer and
+// forwards messages derived from consumed ones atomically with the commit of
+// the input message offsets.
+type TransactionalForwarder struct {
+	Configuration TransactionalForwarderConfiguration
+	producer      sarama.AsyncProducer
+}
+
+// NewTransactionalForwarder constructs a TransactionalForwarder whose
+// producer is configured for idempotent, transactional writes. The
+// transactional ID is derived from the configured prefix and the partition
+// the forwarder will be serving, so that it stays unique per
+// partition/consumer-group as required by the Kafka transaction protocol.
+func NewTransactionalForwarder(
+	brokerCfg BrokerConfiguration,
+	partition int32,
+	forwarderCfg TransactionalForwarderConfiguration,
+) (*TransactionalForwarder, error) {
+	producerConfig, err := newTransactionalProducerConfig(brokerCfg, partition, forwarderCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	producer, err := sarama.NewAsyncProducer([]string{brokerCfg.Address}, producerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	forwarder := &TransactionalForwarder{
+		Configuration: forwarderCfg,
+		producer:      producer,
+	}
+	forwarder.drainErrors()
+
+	return forwarder, nil
+}
+
+// newTransactionalProducerConfig builds the sarama.Config for the
+// transactional producer backing a TransactionalForwarder: the protocol
+// version and security settings mirror those used by the consumer side in
+// NewWithSaramaConfig, except the version defaults to V0_11_0_0 rather than
+// the consumer's V0_10_2_0, since Producer.Idempotent requires at least
+// V0_11_0_0 and sarama's Config.Validate rejects anything older. The
+// producer also needs the same SASL/TLS credentials as the consumer to
+// reach a secured broker.
+func newTransactionalProducerConfig(
+	brokerCfg BrokerConfiguration,
+	partition int32,
+	forwarderCfg TransactionalForwarderConfiguration,
+) (*sarama.Config, error) {
+	producerConfig := sarama.NewConfig()
+	producerConfig.Version = sarama.V0_11_0_0
+
+	if brokerCfg.KafkaVersion != "" {
+		version, err := sarama.ParseKafkaVersion(brokerCfg.KafkaVersion)
+		if err != nil {
+			return nil, err
+		}
+		producerConfig.Version = version
+	}
+
+	if !producerConfig.Version.IsAtLeast(sarama.V0_11_0_0) {
+		return nil, fmt.Errorf("transactional forwarder requires Kafka version >= 0.11.0.0, got %s", brokerCfg.KafkaVersion)
+	}
+
+	producerConfig.Producer.Idempotent = true
+	producerConfig.Producer.RequiredAcks = sarama.WaitForAll
+	producerConfig.Net.MaxOpenRequests = 1
+	producerConfig.Producer.Transaction.ID = fmt.Sprintf("%s-%s-%d", forwarderCfg.TransactionalIDPrefix, brokerCfg.Group, partition)
+	producerConfig.Consumer.IsolationLevel = sarama.ReadCommitted
+
+	if brokerCfg.Security != nil {
+		if err := configureSecurity(producerConfig, *brokerCfg.Security); err != nil {
+			return nil, err
+		}
+	}
+
+	return producerConfig, nil
+}
+
+// drainErrors runs for the lifetime of the forwarder, logging every
+// produce error delivered on the producer's Errors channel. sarama's
+// AsyncProducer requires this channel (enabled by default via
+// Producer.Return.Errors) to be drained continuously, or its internal
+// dispatch loop deadlocks and every future Input()/transaction call wedges.
+func (forwarder *TransactionalForwarder) drainErrors() {
+	go func() {
+		for producerErr := range forwarder.producer.Errors() {
+			log.Error().
+				Err(producerErr.Err).
+				Str(topicKey, producerErr.Msg.Topic).
+				Msg("Unable to produce message transactionally")
+		}
+	}()
+}
+
+// ForwardAndCommit runs the transform function over the given batch of
+// claimed messages, produces the derived messages to the output topic, adds
+// every input message to the transaction so its offset is committed
+// alongside it, and commits the transaction. On any error after BeginTxn has
+// succeeded, the transaction is aborted via abort, which resets session's
+// offset for the partition back to the first message in the batch so it will
+// be reprocessed from there. A BeginTxn error is returned as is. session is
+// the ConsumerGroupSession the batch was claimed under.
+func (forwarder *TransactionalForwarder) ForwardAndCommit(session sarama.ConsumerGroupSession, groupID string, messages []*sarama.ConsumerMessage) error {
+	if err := forwarder.producer.BeginTxn(); err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		outputs, err := forwarder.Configuration.Transform(msg)
+		if err != nil {
+			forwarder.abort(session, messages)
+			return err
+		}
+
+		for _, output := range outputs {
+			output.Topic = forwarder.Configuration.OutputTopic
+			forwarder.producer.Input() <- output
+		}
+
+		if err := forwarder.producer.AddMessageToTxn(msg, groupID, nil); err != nil {
+			forwarder.abort(session, messages)
+			return err
+		}
+	}
+
+	if err := forwarder.producer.CommitTxn(); err != nil {
+		forwarder.abort(session, messages)
+		return err
+	}
+
+	return nil
+}
+
+// abort aborts the current transaction and resets session's offset back to
+// the position of the first message in the failed batch, so the next
+// attempt picks the batch up again. If AbortTxn fails, the error is logged
+// and the offset is not reset.
+func (forwarder *TransactionalForwarder) abort(session sarama.ConsumerGroupSession, messages []*sarama.ConsumerMessage) {
+	if err := forwarder.producer.AbortTxn(); err != nil {
+		log.Error().Err(err).Msg("Unable to abort Kafka transaction")
+		return
+	}
+
+	resetBatchOffset(session, messages)
+}
+
+// resetBatchOffset resets session's offset back to the position of the
+// first message in messages, so the next ConsumeClaim attempt for this
+// partition picks the batch up again. Does nothing for an empty batch.
+func resetBatchOffset(session sarama.ConsumerGroupSession, messages []*sarama.ConsumerMessage) {
+	if len(messages) == 0 {
+		return
+	}
+
+	first := messages[0]
+
+	session.ResetOffset(first.Topic, first.Partition, first.Offset, "")
+}
+
+// Close shuts down the underlying transactional producer.
+func (forwarder *TransactionalForwarder) Close() error {
+	return forwarder.producer.Close()
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNewTransactionalProducerConfig checks that the transactional producer
+// config is idempotent, uses a unique per-partition transactional ID, and
+// picks up both the configured Kafka version and security settings, so a
+// producer built from it can actually start a transaction against a secured
+// broker.
+func TestNewTransactionalProducerConfig(t *testing.T) {
+	brokerCfg := BrokerConfiguration{
+		Group:        "test-group",
+		KafkaVersion: "2.8.0",
+		Security: &SecurityConfiguration{
+			SASLMechanism: "PLAIN",
+			Username:      "user",
+			Password:      "pass",
+		},
+	}
+	forwarderCfg := TransactionalForwarderConfiguration{TransactionalIDPrefix: "forwarder"}
+
+	producerConfig, err := newTransactionalProducerConfig(brokerCfg, 3, forwarderCfg)
+
+	assert.NoError(t, err)
+	assert.True(t, producerConfig.Producer.Idempotent)
+	assert.Equal(t, 1, producerConfig.Net.MaxOpenRequests)
+	assert.Equal(t, "forwarder-test-group-3", producerConfig.Producer.Transaction.ID)
+	assert.Equal(t, sarama.ReadCommitted, producerConfig.Consumer.IsolationLevel)
+	assert.True(t, producerConfig.Version.IsAtLeast(sarama.V2_8_0_0))
+	assert.True(t, producerConfig.Net.SASL.Enable)
+}
+
+// TestNewTransactionalProducerConfigUnknownVersion checks that an invalid
+// KafkaVersion is rejected rather than silently falling back to the default.
+func TestNewTransactionalProducerConfigUnknownVersion(t *testing.T) {
+	brokerCfg := BrokerConfiguration{KafkaVersion: "not-a-version"}
+
+	_, err := newTransactionalProducerConfig(brokerCfg, 0, TransactionalForwarderConfiguration{})
+
+	assert.Error(t, err)
+}
+
+// TestNewTransactionalProducerConfigDefaultVersion checks that, with no
+// KafkaVersion configured, the producer still defaults to a version new
+// enough for Producer.Idempotent, instead of the consumer side's older
+// V0_10_2_0 default which sarama.Config.Validate rejects once Idempotent is
+// set.
+func TestNewTransactionalProducerConfigDefaultVersion(t *testing.T) {
+	brokerCfg := BrokerConfiguration{Group: "g"}
+
+	producerConfig, err := newTransactionalProducerConfig(brokerCfg, 0, TransactionalForwarderConfiguration{})
+
+	assert.NoError(t, err)
+	assert.True(t, producerConfig.Version.IsAtLeast(sarama.V0_11_0_0))
+	assert.NoError(t, producerConfig.Validate())
+}
+
+// TestNewTransactionalProducerConfigVersionTooOld checks that an explicitly
+// configured KafkaVersion below what Producer.Idempotent requires is
+// rejected, rather than producing a config that sarama.NewAsyncProducer
+// would fail on anyway.
+func TestNewTransactionalProducerConfigVersionTooOld(t *testing.T) {
+	brokerCfg := BrokerConfiguration{KafkaVersion: "0.10.2.0"}
+
+	_, err := newTransactionalProducerConfig(brokerCfg, 0, TransactionalForwarderConfiguration{})
+
+	assert.Error(t, err)
+}
+
+// TestResetBatchOffsetUsesFirstMessage checks that resetBatchOffset resets
+// session's offset to the first message of the batch, which is what abort
+// relies on to make a failed batch get reprocessed from the right place.
+func TestResetBatchOffsetUsesFirstMessage(t *testing.T) {
+	session := &fakeSession{}
+	messages := []*sarama.ConsumerMessage{
+		{Topic: "test-topic", Partition: 2, Offset: 41},
+		{Topic: "test-topic", Partition: 2, Offset: 42},
+	}
+
+	resetBatchOffset(session, messages)
+
+	assert.Len(t, session.resets, 1)
+	assert.Equal(t, int64(41), session.resets[0].offset)
+}
+
+// TestResetBatchOffsetEmptyBatch checks that resetBatchOffset is a no-op for
+// an empty batch.
+func TestResetBatchOffsetEmptyBatch(t *testing.T) {
+	session := &fakeSession{}
+
+	resetBatchOffset(session, nil)
+
+	assert.Empty(t, session.resets)
+}